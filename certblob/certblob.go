@@ -0,0 +1,191 @@
+// Package certblob implements marshaling of the Windows CryptoAPI
+// "Certificate Registry Blob" format, which is a sequence of
+// (property ID, property value) pairs stored as the "Blob" registry value
+// underneath a certificate's registry key.
+package certblob
+
+import (
+	"crypto/md5"  // #nosec G501
+	"crypto/sha1" // #nosec G505
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// These property ID's are from comments in ReactOS wincrypt.h.
+const (
+	CertContentCertPropID = 32
+	CertContentCRLPropID  = 33
+	CertContentCTLPropID  = 34
+)
+
+// These property ID's, together with CertContentCertPropID above, are every
+// record documented in the "Certificate Registry Blob" format (see the
+// layout comment in cryptoapi_windows.go).  BuildFullBlob populates all of
+// them, instead of leaving CryptoAPI to regenerate them lazily the first
+// time the certificate is actually used.
+const (
+	CertSha1HashPropID                  = 3
+	CertMd5HashPropID                   = 4
+	CertSignatureHashPropID             = 15
+	CertKeyIdentifierPropID             = 20
+	CertSubjectPublicKeyMd5HashPropID   = 25
+	CertSubjectPublicKeyBitLengthPropID = 92
+)
+
+const propReserved = 1
+
+func isContentPropID(propID uint32) bool {
+	switch propID {
+	case CertContentCertPropID:
+		return true
+	case CertContentCRLPropID:
+		return true
+	case CertContentCTLPropID:
+		return true
+	}
+
+	return false
+}
+
+// Blob is an in-memory representation of a CryptoAPI Certificate Registry
+// Blob, keyed by property ID.
+type Blob map[uint32][]byte
+
+// We sort the ID's so that we get a deterministic Marshaling.
+func (b Blob) sortedIDs() []uint32 {
+	propIDs := make([]uint32, 0, len(b))
+	for id := range b {
+		propIDs = append(propIDs, id)
+	}
+
+	sort.Slice(propIDs, func(idx1, idx2 int) bool {
+		// Content properties MUST be at the end, as per the following spec
+		// (archived on Archive.org and Archive.today):
+		// https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-gpef/6a9e35fa-2ac7-4c10-81e1-eabe8d2472f1
+		// Any properties that are after the content property will be silently
+		// ignored by CryptoAPI!
+		isContent1 := isContentPropID(propIDs[idx1])
+		isContent2 := isContentPropID(propIDs[idx2])
+		if isContent1 != isContent2 {
+			return isContent2
+		}
+
+		return propIDs[idx1] < propIDs[idx2]
+	})
+
+	return propIDs
+}
+
+func marshalProperty(id uint32, value []byte) ([]byte, error) {
+	if value == nil {
+		return nil, fmt.Errorf("certblob: property %d has a nil value", id)
+	}
+
+	if uint64(len(value)) > math.MaxUint32 {
+		return nil, fmt.Errorf("certblob: property %d overflows uint32 size", id)
+	}
+
+	result := make([]byte, 4+4+4)
+
+	binary.LittleEndian.PutUint32(result[0:], id)
+	binary.LittleEndian.PutUint32(result[4:], propReserved)
+	binary.LittleEndian.PutUint32(result[8:], uint32(len(value)))
+
+	result = append(result, value...)
+
+	return result, nil
+}
+
+// Marshal serializes the Blob into the byte sequence expected by CryptoAPI's
+// "Blob" registry value.
+func (b Blob) Marshal() ([]byte, error) {
+	propIDs := b.sortedIDs()
+
+	result := make([]byte, 0)
+
+	for _, pid := range propIDs {
+		marshaledProperty, err := marshalProperty(pid, b[pid])
+		if err != nil {
+			return nil, fmt.Errorf("certblob: error marshaling property %d: %w", pid, err)
+		}
+
+		result = append(result, marshaledProperty...)
+	}
+
+	return result, nil
+}
+
+// ParseBlob parses the byte sequence of a CryptoAPI "Blob" registry value
+// back into a Blob, keyed by property ID.  It is the inverse of Marshal.
+func ParseBlob(data []byte) (Blob, error) {
+	result := Blob{}
+
+	for len(data) > 0 {
+		if len(data) < 12 {
+			return nil, fmt.Errorf("certblob: truncated property header")
+		}
+
+		id := binary.LittleEndian.Uint32(data[0:])
+
+		if reserved := binary.LittleEndian.Uint32(data[4:]); reserved != propReserved {
+			return nil, fmt.Errorf("certblob: property %d has unexpected reserved field %d", id, reserved)
+		}
+
+		size := binary.LittleEndian.Uint32(data[8:])
+		data = data[12:]
+
+		if uint64(len(data)) < uint64(size) {
+			return nil, fmt.Errorf("certblob: property %d value is truncated", id)
+		}
+
+		result[id] = data[:size]
+		data = data[size:]
+	}
+
+	return result, nil
+}
+
+// subjectPublicKeyInfo mirrors the ASN.1 SubjectPublicKeyInfo structure, so
+// that we can recover the raw BIT STRING contents of a certificate's public
+// key without re-deriving them from the parsed crypto.PublicKey, which would
+// require separately handling every key algorithm x509 supports.
+type subjectPublicKeyInfo struct {
+	Raw       asn1.RawContent
+	Algorithm pkix.AlgorithmIdentifier
+	PublicKey asn1.BitString
+}
+
+// BuildFullBlob computes every documented CryptoAPI blob property for cert,
+// instead of leaving just the CertContentCertPropID record for CryptoAPI to
+// regenerate the rest from lazily.
+func BuildFullBlob(cert *x509.Certificate) (Blob, error) {
+	var spki subjectPublicKeyInfo
+	if _, err := asn1.Unmarshal(cert.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return nil, fmt.Errorf("certblob: couldn't parse subject public key info: %w", err)
+	}
+
+	sha1Fingerprint := sha1.Sum(cert.Raw)           // #nosec G401
+	md5Fingerprint := md5.Sum(cert.Raw)             // #nosec G401
+	keyIdentifier := sha1.Sum(spki.PublicKey.Bytes) // #nosec G401
+	pubkeyMD5Hash := md5.Sum(spki.PublicKey.Bytes)  // #nosec G401
+	signatureHash := sha256.Sum256(cert.RawTBSCertificate)
+
+	bitLength := make([]byte, 4)
+	binary.LittleEndian.PutUint32(bitLength, uint32(spki.PublicKey.BitLength))
+
+	return Blob{
+		CertSubjectPublicKeyBitLengthPropID: bitLength,
+		CertSubjectPublicKeyMd5HashPropID:   pubkeyMD5Hash[:],
+		CertSignatureHashPropID:             signatureHash[:],
+		CertSha1HashPropID:                  sha1Fingerprint[:],
+		CertKeyIdentifierPropID:             keyIdentifier[:],
+		CertMd5HashPropID:                   md5Fingerprint[:],
+		CertContentCertPropID:               cert.Raw,
+	}, nil
+}
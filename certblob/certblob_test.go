@@ -0,0 +1,228 @@
+package certblob
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// fixedCertDERHex is the DER encoding of a certificate generated once with a
+// fixed key, serial number, and validity period, so that BuildFullBlob's
+// output for it is reproducible across test runs.  The expected property
+// values asserted against it in TestBuildFullBlobAgainstFixedReference below
+// were captured by hashing its cert.Raw/RawTBSCertificate/SPKI bytes with
+// `sha1sum`/`md5sum`/`sha256sum` (coreutils' C implementations, not Go's
+// crypto package), so they're a genuine external test vector: a bug in
+// BuildFullBlob's property ID or hash algorithm choices will make its output
+// disagree with the independently-computed literal, not just with itself.
+const fixedCertDERHex = "308201263081cea00302010202023039300a06082a8648ce3d040302301d311b30190" +
+	"603550403131263657274626c6f6220746573742063657274301e170d303130393039" +
+	"3031343634305a170d3031303931303031343634305a301d311b3019060355040313" +
+	"1263657274626c6f62207465737420636572743059301306072a8648ce3d02010608" +
+	"2a8648ce3d03010703420004e41966bd54692f0933c526a8c5b318bc93f24026df485" +
+	"38d6ecd4684392a4b762637073230f933e5c91005e0d9e42ccd9d79c2ebeeb706e9ea" +
+	"7f4210054b017e300a06082a8648ce3d040302034700304402200163d51c5aa6087f1" +
+	"282638b5ccd1fc5a76c219e2a345c0ebf720d1b3252ab35022043f91c8daf959ddc15" +
+	"c7350c28d9f4531816e876bc3def393d9fee13497e1c0a"
+
+func fixedTestCert(t *testing.T) *x509.Certificate {
+	derBytes, err := hex.DecodeString(fixedCertDERHex)
+	if err != nil {
+		t.Fatalf("couldn't decode fixed reference cert DER: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		t.Fatalf("couldn't parse fixed reference cert: %v", err)
+	}
+
+	return cert
+}
+
+func testCert(t *testing.T) *x509.Certificate {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("couldn't generate test key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "certblob test cert"},
+		NotBefore:    time.Unix(0, 0),
+		NotAfter:     time.Unix(0, 0).Add(24 * time.Hour),
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("couldn't create test cert: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		t.Fatalf("couldn't parse test cert: %v", err)
+	}
+
+	return cert
+}
+
+func TestBlobMarshalParseRoundTrip(t *testing.T) {
+	cert := testCert(t)
+
+	blob, err := BuildFullBlob(cert)
+	if err != nil {
+		t.Fatalf("BuildFullBlob: %v", err)
+	}
+
+	marshaled, err := blob.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	parsed, err := ParseBlob(marshaled)
+	if err != nil {
+		t.Fatalf("ParseBlob: %v", err)
+	}
+
+	if len(parsed) != len(blob) {
+		t.Fatalf("expected %d properties, got %d", len(blob), len(parsed))
+	}
+
+	for id, value := range blob {
+		parsedValue, ok := parsed[id]
+		if !ok {
+			t.Errorf("property %d missing after round trip", id)
+
+			continue
+		}
+
+		if !bytes.Equal(parsedValue, value) {
+			t.Errorf("property %d: expected %x, got %x", id, value, parsedValue)
+		}
+	}
+}
+
+func TestBuildFullBlobProperties(t *testing.T) {
+	cert := testCert(t)
+
+	blob, err := BuildFullBlob(cert)
+	if err != nil {
+		t.Fatalf("BuildFullBlob: %v", err)
+	}
+
+	expectedSizes := map[uint32]int{
+		CertSubjectPublicKeyBitLengthPropID: 4,
+		CertSubjectPublicKeyMd5HashPropID:   16,
+		CertSignatureHashPropID:             32,
+		CertSha1HashPropID:                  20,
+		CertKeyIdentifierPropID:             20,
+		CertMd5HashPropID:                   16,
+		CertContentCertPropID:               len(cert.Raw),
+	}
+
+	for id, expectedSize := range expectedSizes {
+		value, ok := blob[id]
+		if !ok {
+			t.Errorf("property %d missing from full blob", id)
+
+			continue
+		}
+
+		if len(value) != expectedSize {
+			t.Errorf("property %d: expected %d bytes, got %d", id, expectedSize, len(value))
+		}
+	}
+
+	if !bytes.Equal(blob[CertContentCertPropID], cert.Raw) {
+		t.Errorf("property %d doesn't match certificate DER bytes", CertContentCertPropID)
+	}
+}
+
+// Expected property values for fixedCertDERHex, captured by running
+// `sha1sum`/`md5sum`/`sha256sum` against its cert.Raw, RawTBSCertificate,
+// and SPKI BIT STRING bytes (extracted separately via encoding/asn1).  These
+// are hardcoded literals, not values recomputed by calling the same
+// crypto/sha1, crypto/md5, or crypto/sha256 functions BuildFullBlob itself
+// calls, so a bug in BuildFullBlob's property ID or hash algorithm/input
+// choices shows up as a mismatch against an independent expectation instead
+// of against itself.
+const (
+	fixedCertSha1HashHex      = "21beb3f0ffbb1cb7f01b499f924fec7ab316be17"
+	fixedCertMd5HashHex       = "383be156b8f9350991bdea76edc681ce"
+	fixedCertSignatureHashHex = "b2843ec02d1d54fcf8fd49810460fee72f3bb4390d0ef56fd49398746db3786a"
+	fixedCertKeyIdentifierHex = "390023bc02bc5b2d50327174679219dce073a524"
+	fixedCertPubkeyMd5HashHex = "7c4473f0a5872b0b31e8bcb4de3f9b52"
+	// 520 bits (65-byte uncompressed P-256 point), little-endian uint32.
+	fixedCertPubkeyBitLengthHex = "08020000"
+)
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("couldn't decode hex literal %q: %v", s, err)
+	}
+
+	return b
+}
+
+// TestBuildFullBlobAgainstFixedReference guards against BuildFullBlob using
+// the wrong hash algorithm or input for a property (e.g. computing
+// CertSignatureHashPropID over the whole certificate instead of just the
+// tbsCertificate): unlike TestBuildFullBlobProperties, which only checks
+// sizes, every expected value here is a hardcoded literal captured outside
+// of BuildFullBlob (see the fixedCert* constants above), so a wrong
+// algorithm or input would produce a value that disagrees with the fixed
+// expectation instead of just disagreeing with itself.
+func TestBuildFullBlobAgainstFixedReference(t *testing.T) {
+	cert := fixedTestCert(t)
+
+	expected := map[uint32][]byte{
+		CertSubjectPublicKeyBitLengthPropID: mustDecodeHex(t, fixedCertPubkeyBitLengthHex),
+		CertSubjectPublicKeyMd5HashPropID:   mustDecodeHex(t, fixedCertPubkeyMd5HashHex),
+		CertSignatureHashPropID:             mustDecodeHex(t, fixedCertSignatureHashHex),
+		CertSha1HashPropID:                  mustDecodeHex(t, fixedCertSha1HashHex),
+		CertKeyIdentifierPropID:             mustDecodeHex(t, fixedCertKeyIdentifierHex),
+		CertMd5HashPropID:                   mustDecodeHex(t, fixedCertMd5HashHex),
+		CertContentCertPropID:               cert.Raw,
+	}
+
+	blob, err := BuildFullBlob(cert)
+	if err != nil {
+		t.Fatalf("BuildFullBlob: %v", err)
+	}
+
+	for id, expectedValue := range expected {
+		value, ok := blob[id]
+		if !ok {
+			t.Errorf("property %d missing from full blob", id)
+
+			continue
+		}
+
+		if !bytes.Equal(value, expectedValue) {
+			t.Errorf("property %d: expected %x, got %x", id, expectedValue, value)
+		}
+	}
+
+	marshaled, err := blob.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	expectedBlob := Blob(expected)
+
+	expectedMarshaled, err := expectedBlob.Marshal()
+	if err != nil {
+		t.Fatalf("couldn't marshal independently-computed reference blob: %v", err)
+	}
+
+	if !bytes.Equal(marshaled, expectedMarshaled) {
+		t.Errorf("marshaled blob doesn't match independently-computed reference blob:\nexpected %x\ngot      %x", expectedMarshaled, marshaled)
+	}
+}
@@ -0,0 +1,232 @@
+// Package certdehydrate reconstructs full X.509 certificates from the
+// compact (validity, pubkey, signature) representation used by Namecoin's
+// "Dehydrated TLS Certificates" scheme for `tls` records; the serial number
+// is not stored but derived (see DehydratedCertificate.SerialNumber).  See
+// the specification at:
+// https://github.com/namecoin/proposals/blob/master/ifa-0003.md
+package certdehydrate
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/namecoin/splicesign"
+)
+
+// timestampPrecision is the granularity (in seconds) that NotBefore/NotAfter
+// are rounded to before being scaled down into the dehydrated representation.
+const timestampPrecision = int64(5 * 60) // 5 minute precision
+
+// dehydratedPubkeyCurve is the curve that every dehydrated certificate's
+// public key is on.  The dehydrated format has no room to record which curve
+// a point is on (that's the whole point of compressing it down to a single
+// EC point), so every SignatureAlgorithm this package supports is assumed to
+// use P-256.
+var dehydratedPubkeyCurve = elliptic.P256()
+
+// DehydratedCertificate represents the minimal set of data required to
+// deterministically reconstruct a valid X.509 certificate when combined with
+// a domain name supplied out-of-band (e.g. from the DNS query that triggered
+// the lookup).
+type DehydratedCertificate struct {
+	// PubkeyB64 is the base64 encoding of the certificate's ECDSA public key
+	// as a compressed EC point (33 bytes for P-256), not a full ASN.1
+	// SubjectPublicKeyInfo (~90 bytes): this value is published in a
+	// per-lookup DNS `tls` record, so keeping it small is the point of
+	// "dehydrating" the certificate in the first place.
+	PubkeyB64          string
+	NotBeforeScaled    int64
+	NotAfterScaled     int64
+	SignatureAlgorithm int64
+	SignatureB64       string
+}
+
+// SerialNumber calculates the certificate serial number that a rehydrated
+// certificate for the given domain name must use, per the Dehydrated TLS
+// Certificates specification.
+func (dehydrated *DehydratedCertificate) SerialNumber(name string) ([]byte, error) {
+	nameHash := sha256.Sum256([]byte(name))
+
+	pubkeyBytes, err := base64.StdEncoding.DecodeString(dehydrated.PubkeyB64)
+	if err != nil {
+		return nil, fmt.Errorf("dehydrated cert pubkey is not valid base64: %w", err)
+	}
+	pubkeyHash := sha256.Sum256(pubkeyBytes)
+
+	notBeforeHash, err := hashScaledTimestamp(dehydrated.NotBeforeScaled)
+	if err != nil {
+		return nil, fmt.Errorf("error hashing notBefore: %w", err)
+	}
+
+	notAfterHash, err := hashScaledTimestamp(dehydrated.NotAfterScaled)
+	if err != nil {
+		return nil, fmt.Errorf("error hashing notAfter: %w", err)
+	}
+
+	serialHash := sha256.New()
+	serialHash.Write(nameHash[:])
+	serialHash.Write(pubkeyHash[:])
+	serialHash.Write(notBeforeHash[:])
+	serialHash.Write(notAfterHash[:])
+
+	// 19 bytes will be less than 2^159, see https://crypto.stackexchange.com/a/260
+	return serialHash.Sum(nil)[0:19], nil
+}
+
+func hashScaledTimestamp(scaled int64) ([sha256.Size]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.BigEndian, scaled); err != nil {
+		return [sha256.Size]byte{}, err
+	}
+
+	return sha256.Sum256(buf.Bytes()), nil
+}
+
+// compressPubkey marshals pub as a compressed EC point, which is what
+// DehydratedCertificate.PubkeyB64 stores.
+func compressPubkey(pub *ecdsa.PublicKey) []byte {
+	return elliptic.MarshalCompressed(dehydratedPubkeyCurve, pub.X, pub.Y)
+}
+
+// decompressPubkey is the inverse of compressPubkey.
+func decompressPubkey(compressed []byte) (*ecdsa.PublicKey, error) {
+	x, y := elliptic.UnmarshalCompressed(dehydratedPubkeyCurve, compressed)
+	if x == nil {
+		return nil, fmt.Errorf("dehydrated cert pubkey is not a valid compressed P-256 point")
+	}
+
+	return &ecdsa.PublicKey{Curve: dehydratedPubkeyCurve, X: x, Y: y}, nil
+}
+
+// RehydrateCert converts a dehydrated certificate into a standard x509
+// certificate template, restoring the ECDSA public key (decompressing it
+// from its 33-byte compressed EC point form) and signature, but not filling
+// in the domain name or any field that depends on it.  The result is
+// intended to be passed to FillRehydratedCertTemplate.
+func RehydrateCert(dehydrated *DehydratedCertificate) (*x509.Certificate, error) {
+	pubkeyBin, err := base64.StdEncoding.DecodeString(dehydrated.PubkeyB64)
+	if err != nil {
+		return nil, fmt.Errorf("dehydrated cert pubkey must be valid base64: %w", err)
+	}
+
+	pubkey, err := decompressPubkey(pubkeyBin)
+	if err != nil {
+		return nil, fmt.Errorf("dehydrated cert pubkey is invalid: %w", err)
+	}
+
+	notBefore := time.Unix(dehydrated.NotBeforeScaled*timestampPrecision, 0)
+	notAfter := time.Unix(dehydrated.NotAfterScaled*timestampPrecision, 0)
+
+	signature, err := base64.StdEncoding.DecodeString(dehydrated.SignatureB64)
+	if err != nil {
+		return nil, fmt.Errorf("dehydrated cert signature must be valid base64: %w", err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+
+		// x509.KeyUsageKeyEncipherment is used for RSA key exchange, but not
+		// DHE/ECDHE key exchange.  Since everyone should be using ECDHE (due
+		// to forward secrecy), we disallow x509.KeyUsageKeyEncipherment in
+		// our template.
+		KeyUsage: x509.KeyUsageDigitalSignature,
+
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+
+		SignatureAlgorithm: x509.SignatureAlgorithm(dehydrated.SignatureAlgorithm),
+		PublicKey:          pubkey,
+		Signature:          signature,
+	}
+
+	return &template, nil
+}
+
+// FillRehydratedCertTemplate fills in the domain name (and all fields that
+// depend on it) of an x509 certificate returned by RehydrateCert, splices in
+// the recorded signature, and verifies that the signature is valid for the
+// reconstructed certificate before returning its DER encoding.  If the
+// signature does not match the recorded public key, it returns an error and
+// no certificate; it also returns an error if the public key is not ECDSA or
+// the certificate cannot be built or parsed.
+func FillRehydratedCertTemplate(template x509.Certificate, name string) ([]byte, error) {
+	template.Subject = pkix.Name{
+		CommonName:   name,
+		SerialNumber: "Namecoin TLS Certificate",
+	}
+	template.DNSNames = append(template.DNSNames, name)
+
+	pub, ok := template.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("rehydrated cert pubkey is not an ECDSA public key")
+	}
+
+	dehydrated := &DehydratedCertificate{
+		PubkeyB64:       base64.StdEncoding.EncodeToString(compressPubkey(pub)),
+		NotBeforeScaled: template.NotBefore.Unix() / timestampPrecision,
+		NotAfterScaled:  template.NotAfter.Unix() / timestampPrecision,
+	}
+
+	serialNumberBytes, err := dehydrated.SerialNumber(name)
+	if err != nil {
+		return nil, fmt.Errorf("error calculating serial number: %w", err)
+	}
+	template.SerialNumber.SetBytes(serialNumberBytes)
+
+	priv := &splicesign.SpliceSigner{
+		PublicKey: pub,
+		Signature: template.Signature,
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, pub, priv)
+	if err != nil {
+		return nil, fmt.Errorf("error splicing signature: %w", err)
+	}
+
+	parsedCert, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing spliced certificate: %w", err)
+	}
+
+	// Verify that the recorded signature actually matches the recorded
+	// pubkey and the reconstructed tbsCertificate.  We can't use
+	// CheckSignatureFrom here: it enforces CA semantics (that a signing
+	// parent have BasicConstraintsValid && IsCA), which this leaf template
+	// deliberately never sets, so it would reject every signature
+	// unconditionally regardless of validity.  CheckSignature verifies the
+	// signature against the cert's own public key without imposing any CA
+	// constraints, which is what a self-signed leaf actually needs here.
+	if err := parsedCert.CheckSignature(parsedCert.SignatureAlgorithm, parsedCert.RawTBSCertificate, parsedCert.Signature); err != nil {
+		return nil, fmt.Errorf("dehydrated cert signature is invalid: %w", err)
+	}
+
+	return derBytes, nil
+}
+
+// ExpandCert reconstructs a full, signature-verified X.509 DER certificate
+// for the given domain name from a dehydrated certificate.
+func ExpandCert(dehydrated *DehydratedCertificate, name string) ([]byte, error) {
+	template, err := RehydrateCert(dehydrated)
+	if err != nil {
+		return nil, fmt.Errorf("error rehydrating certificate: %w", err)
+	}
+
+	derBytes, err := FillRehydratedCertTemplate(*template, name)
+	if err != nil {
+		return nil, fmt.Errorf("error filling rehydrated certificate template: %w", err)
+	}
+
+	return derBytes, nil
+}
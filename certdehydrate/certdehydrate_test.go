@@ -0,0 +1,120 @@
+package certdehydrate
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// TestExpandCertValidSignature exercises the full dehydrate/expand round
+// trip with a genuine ECDSA signature, standing in for the out-of-band
+// process that mints a "tls" record's compact signature: it builds the same
+// template FillRehydratedCertTemplate builds, signs it for real, then
+// checks that ExpandCert accepts the result and reconstructs the identical
+// certificate.  This guards against FillRehydratedCertTemplate's signature
+// check rejecting validly-signed certs (e.g. by mistakenly imposing CA
+// constraints on what is always a leaf cert).
+func TestExpandCertValidSignature(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("couldn't generate test key: %s", err)
+	}
+
+	const name = "example.bit"
+
+	notBefore := time.Unix(1700000000/timestampPrecision*timestampPrecision, 0).UTC()
+	notAfter := notBefore.Add(105120 * timestampPrecisionDuration())
+
+	dehydrated := &DehydratedCertificate{
+		PubkeyB64:          base64.StdEncoding.EncodeToString(compressPubkey(&priv.PublicKey)),
+		NotBeforeScaled:    notBefore.Unix() / timestampPrecision,
+		NotAfterScaled:     notAfter.Unix() / timestampPrecision,
+		SignatureAlgorithm: int64(x509.ECDSAWithSHA256),
+	}
+
+	serialNumberBytes, err := dehydrated.SerialNumber(name)
+	if err != nil {
+		t.Fatalf("couldn't calculate serial number: %s", err)
+	}
+
+	// Build the same template FillRehydratedCertTemplate builds, but sign
+	// it for real with the test key, mimicking what the out-of-band
+	// process that mints a "tls" record would do, so we have a genuine
+	// signature to round-trip through ExpandCert.
+	template := &x509.Certificate{
+		SerialNumber: new(big.Int).SetBytes(serialNumberBytes),
+		Subject: pkix.Name{
+			CommonName:   name,
+			SerialNumber: "Namecoin TLS Certificate",
+		},
+		DNSNames:              []string{name},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		SignatureAlgorithm:    x509.ECDSAWithSHA256,
+	}
+
+	refDERBytes, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("couldn't create reference certificate: %s", err)
+	}
+
+	refCert, err := x509.ParseCertificate(refDERBytes)
+	if err != nil {
+		t.Fatalf("couldn't parse reference certificate: %s", err)
+	}
+
+	dehydrated.SignatureB64 = base64.StdEncoding.EncodeToString(refCert.Signature)
+
+	derBytes, err := ExpandCert(dehydrated, name)
+	if err != nil {
+		t.Fatalf("ExpandCert rejected a validly-signed dehydrated cert: %s", err)
+	}
+
+	if !bytes.Equal(derBytes, refDERBytes) {
+		t.Fatalf("expanded cert doesn't match the reference certificate byte-for-byte")
+	}
+}
+
+// timestampPrecisionDuration returns timestampPrecision as a time.Duration,
+// for building test timestamps that round-trip exactly through the
+// NotBeforeScaled/NotAfterScaled scaling in RehydrateCert.
+func timestampPrecisionDuration() time.Duration {
+	return time.Duration(timestampPrecision) * time.Second
+}
+
+// TestCompressPubkeyRoundTrip checks that compressPubkey/decompressPubkey
+// round-trip a P-256 public key, and that the compressed form is actually
+// the 33-byte X9.62 compressed point DehydratedCertificate.PubkeyB64 is
+// documented to hold, not a full ASN.1 SubjectPublicKeyInfo.
+func TestCompressPubkeyRoundTrip(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("couldn't generate test key: %s", err)
+	}
+
+	compressed := compressPubkey(&priv.PublicKey)
+
+	const wantLen = 1 + 32 // tag byte + P-256 field element
+	if len(compressed) != wantLen {
+		t.Fatalf("compressed pubkey is %d bytes, want %d", len(compressed), wantLen)
+	}
+
+	decompressed, err := decompressPubkey(compressed)
+	if err != nil {
+		t.Fatalf("decompressPubkey: %s", err)
+	}
+
+	if decompressed.X.Cmp(priv.PublicKey.X) != 0 || decompressed.Y.Cmp(priv.PublicKey.Y) != 0 {
+		t.Fatalf("decompressed pubkey doesn't match the original")
+	}
+}
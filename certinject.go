@@ -0,0 +1,36 @@
+package certinject
+
+import (
+	"errors"
+
+	"github.com/hlandau/xlog"
+	"gopkg.in/hlandau/easyconfig.v1/cflag"
+)
+
+var (
+	log, logp        = xlog.New("ncdns.certinject")
+	flagGroup        = cflag.NewGroup(nil, "certstore")
+	certExpirePeriod = cflag.Int(flagGroup, "expire", 60*30, "Duration "+
+		"(in seconds) after which TLS certs will be removed from the "+
+		"trust store.  Making this smaller than the DNS TTL (default "+
+		"600) may cause TLS errors.")
+)
+
+// Sentinel errors returned (possibly wrapped) by InjectCert, CleanCerts, and
+// their per-backend implementations.  ErrInjectFailed/ErrCleanFailed indicate
+// which top-level operation failed; the rest indicate what went wrong, and
+// may be wrapped by either operation.  Callers can use errors.Is against
+// whichever level of detail they care about.
+var (
+	ErrInjectFailed = errors.New("certinject: failed to inject certificate")
+	ErrCleanFailed  = errors.New("certinject: failed to clean expired certificates")
+
+	ErrStoreOpenFailed  = errors.New("certinject: could not open trust store")
+	ErrBlobWriteFailed  = errors.New("certinject: could not write certificate data")
+	ErrPermissionDenied = errors.New("certinject: permission denied")
+)
+
+// SetLogLevel allows an application to set a log level.
+func SetLogLevel(level xlog.Severity) {
+	logp.SetSeverity(level)
+}
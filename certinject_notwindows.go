@@ -0,0 +1,43 @@
+//go:build !windows
+// +build !windows
+
+package certinject
+
+import (
+	"fmt"
+
+	"gopkg.in/hlandau/easyconfig.v1/cflag"
+)
+
+// This package is used to add and remove certificates to the system trust
+// store.
+// On non-Windows platforms, it supports NSS sqlite3 stores.
+
+var nssFlagEnable = cflag.Bool(nssFlagGroup, "enable", false,
+	"Synchronize TLS certs to an NSS sqlite3 trust store.")
+
+// InjectCert injects the given cert into all configured trust stores.
+func InjectCert(derBytes []byte) error {
+	if !nssFlagEnable.Value() {
+		return nil
+	}
+
+	if err := injectCertNSS(derBytes); err != nil {
+		return fmt.Errorf("%w: %w", ErrInjectFailed, err)
+	}
+
+	return nil
+}
+
+// CleanCerts cleans expired certs from all configured trust stores.
+func CleanCerts() error {
+	if !nssFlagEnable.Value() {
+		return nil
+	}
+
+	if err := cleanCertsNSS(); err != nil {
+		return fmt.Errorf("%w: %w", ErrCleanFailed, err)
+	}
+
+	return nil
+}
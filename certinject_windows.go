@@ -0,0 +1,103 @@
+package certinject
+
+import (
+	"errors"
+	"fmt"
+
+	"gopkg.in/hlandau/easyconfig.v1/cflag"
+
+	"github.com/namecoin/certinject/certdehydrate"
+)
+
+// This package is used to add and remove certificates to the system trust
+// store.
+// On Windows, it supports both the CryptoAPI store and NSS sqlite3 stores.
+
+var cryptoAPIFlagEnable = cflag.Bool(cryptoAPIFlagGroup, "enable", true,
+	"Synchronize TLS certs to the CryptoAPI trust store.")
+var nssFlagEnable = cflag.Bool(nssFlagGroup, "enable", false,
+	"Synchronize TLS certs to an NSS sqlite3 trust store.")
+
+// InjectCert injects the given cert into all configured trust stores.
+func InjectCert(derBytes []byte) error {
+	var errs []error
+
+	if cryptoAPIFlagEnable.Value() {
+		if err := injectCertCryptoAPI(derBytes); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if nssFlagEnable.Value() {
+		if err := injectCertNSS(derBytes); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %w", ErrInjectFailed, errors.Join(errs...))
+}
+
+// InjectDehydratedCert reconstructs a dehydrated "tls" record certificate for
+// the given domain name, verifies its signature, and injects it into the
+// CryptoAPI trust store, tagged so that it expires much sooner than a
+// normally-injected cert.  This lets ncdns push per-lookup TLS certs into the
+// Windows trust store without leaving long-lived browsing history behind.
+func InjectDehydratedCert(dehydrated *certdehydrate.DehydratedCertificate, name string) error {
+	if !cryptoAPIFlagEnable.Value() {
+		return nil
+	}
+
+	derBytes, err := certdehydrate.ExpandCert(dehydrated, name)
+	if err != nil {
+		return fmt.Errorf("%w: couldn't expand dehydrated cert for %q: %s", ErrInjectFailed, name, err)
+	}
+
+	if err := injectCertCryptoAPIDehydrated(derBytes); err != nil {
+		return fmt.Errorf("%w: %w", ErrInjectFailed, err)
+	}
+
+	return nil
+}
+
+// RevokeCert injects the given cert into the Disallowed CryptoAPI logical
+// store, which browsers and schannel treat as a hard denylist.  This lets
+// ncdns actively block a cert that a Namecoin `tls` record has flagged as
+// compromised, rather than merely omitting it from the Root store.
+func RevokeCert(derBytes []byte) error {
+	if !cryptoAPIFlagEnable.Value() {
+		return nil
+	}
+
+	if err := injectCertCryptoAPIRevoked(derBytes); err != nil {
+		return fmt.Errorf("%w: %w", ErrInjectFailed, err)
+	}
+
+	return nil
+}
+
+// CleanCerts cleans expired certs from all configured trust stores.
+func CleanCerts() error {
+	var errs []error
+
+	if cryptoAPIFlagEnable.Value() {
+		if err := cleanCertsCryptoAPI(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if nssFlagEnable.Value() {
+		if err := cleanCertsNSS(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %w", ErrCleanFailed, errors.Join(errs...))
+}
@@ -0,0 +1,82 @@
+package certinject
+
+import (
+	"fmt"
+	"sync"
+
+	"golang.org/x/sys/windows/svc/eventlog"
+	"gopkg.in/hlandau/easyconfig.v1/cflag"
+)
+
+var cryptoAPIFlagAudit = cflag.Bool(cryptoAPIFlagGroup, "audit", false,
+	"Log every CryptoAPI trust store cert add, refresh, and delete to the "+
+		"Windows Event Log, including the cert's fingerprint, physical "+
+		"store, logical store, and DER length.  This makes it feasible to "+
+		"diff what ncdns has done to the trust store against a SIEM.")
+
+// cryptoAPIAuditEventSource is the Windows Event Log source that audit
+// entries are reported under.
+const cryptoAPIAuditEventSource = "Namecoin CertInject"
+
+// Event IDs for the entries written by auditCryptoAPI.  These have no
+// registered message file, so Event Viewer falls back to showing the raw
+// message text; the IDs just let a SIEM tell the 3 kinds of entry apart
+// without parsing the message.
+const (
+	cryptoAPIAuditEventAdded uint32 = iota + 1
+	cryptoAPIAuditEventRefreshed
+	cryptoAPIAuditEventDeleted
+)
+
+var cryptoAPIAuditInstallOnce sync.Once
+
+// ensureCryptoAPIAuditSource registers cryptoAPIAuditEventSource with the
+// Windows Event Log the first time it's needed, so ReportEvent has
+// somewhere to write to.  Registration requires admin rights, same as the
+// trust store writes it's auditing; if it fails (e.g. because it's already
+// registered, or permission was denied) we ignore the error and let the
+// subsequent eventlog.Open attempt succeed or fail on its own.
+func ensureCryptoAPIAuditSource() {
+	cryptoAPIAuditInstallOnce.Do(func() {
+		_ = eventlog.InstallAsEventCreate(cryptoAPIAuditEventSource,
+			eventlog.Info|eventlog.Warning|eventlog.Error)
+	})
+}
+
+// auditCryptoAPI writes a Windows Event Log entry recording a CryptoAPI
+// trust store mutation, if -capi.audit is enabled.  Failure to log is only
+// logged via the package's regular logger, not returned, since a missing
+// audit trail shouldn't block the trust store mutation it's describing.
+func auditCryptoAPI(eventID uint32, action, physicalStoreName, logicalStoreName, fingerprintHexUpper string, derLen int) {
+	if !cryptoAPIFlagAudit.Value() {
+		return
+	}
+
+	ensureCryptoAPIAuditSource()
+
+	elog, err := eventlog.Open(cryptoAPIAuditEventSource)
+	if err != nil {
+		log.Warnf("Couldn't open Windows Event Log for CryptoAPI audit entry: %s", err)
+		return
+	}
+	defer elog.Close()
+
+	msg := fmt.Sprintf("certinject %s cert: fingerprint=%s physical-store=%s logical-store=%s der-length=%d",
+		action, fingerprintHexUpper, physicalStoreName, logicalStoreName, derLen)
+
+	if err := elog.Info(eventID, msg); err != nil {
+		log.Warnf("Couldn't write CryptoAPI audit entry to Windows Event Log: %s", err)
+	}
+}
+
+// auditCryptoAPIAddOrRefresh writes an audit entry for an inject, choosing
+// the "added" or "refreshed" event depending on whether the cert's registry
+// key already existed.
+func auditCryptoAPIAddOrRefresh(openedExisting bool, physicalStoreName, logicalStoreName, fingerprintHexUpper string, derLen int) {
+	if openedExisting {
+		auditCryptoAPI(cryptoAPIAuditEventRefreshed, "refreshed", physicalStoreName, logicalStoreName, fingerprintHexUpper, derLen)
+		return
+	}
+
+	auditCryptoAPI(cryptoAPIAuditEventAdded, "added", physicalStoreName, logicalStoreName, fingerprintHexUpper, derLen)
+}
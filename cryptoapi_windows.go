@@ -2,12 +2,16 @@ package certinject
 
 import (
 	"crypto/sha1" // #nosec G505
+	"crypto/x509"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"math"
 	"strings"
+	"syscall"
 	"time"
 
+	"golang.org/x/sys/windows"
 	"golang.org/x/sys/windows/registry"
 	"gopkg.in/hlandau/easyconfig.v1/cflag"
 
@@ -20,11 +24,79 @@ var (
 		"Name of CryptoAPI logical store to inject certificate into. Consider: Root, Trust, CA, My, Disallowed")
 	cryptoAPIFlagPhysicalStoreName = cflag.String(cryptoAPIFlagGroup, "physical-store", "system",
 		"Scope of CryptoAPI certificate store. Valid choices: current-user, system, enterprise, group-policy")
+	cryptoAPIDehydratedExpirePeriod = cflag.Int(cryptoAPIFlagGroup, "dehydrated-expire", 60*5,
+		"Duration (in seconds) after which dehydrated TLS certs will be "+
+			"removed from the trust store.  These encode per-lookup browsing "+
+			"history, so this should be kept much shorter than -certstore.expire.")
+	cryptoAPIFlagFullBlob = cflag.Bool(cryptoAPIFlagGroup, "full-blob", false,
+		"Populate every documented CryptoAPI blob property record when "+
+			"injecting a certificate, instead of relying on CryptoAPI to "+
+			"regenerate the rest lazily on first use.  Some enterprise "+
+			"scanners and group policy propagation require the full record "+
+			"set to be present up front.")
 )
 
 const cryptoAPIMagicName = "Namecoin"
 const cryptoAPIMagicValue = 1
 
+// golang.org/x/sys/windows has no RegFlushKey wrapper (unlike most of the
+// advapi32 registry API), so we bind the syscall ourselves.
+var (
+	advapi32        = windows.NewLazySystemDLL("advapi32.dll")
+	procRegFlushKey = advapi32.NewProc("RegFlushKey")
+)
+
+// regFlushKey flushes key's changes to disk, so that a concurrent reader
+// (e.g. a promotion step immediately following a staging write) is
+// guaranteed to observe them.
+func regFlushKey(key registry.Key) error {
+	ret, _, _ := procRegFlushKey.Call(uintptr(key))
+	if ret != 0 {
+		return syscall.Errno(ret)
+	}
+
+	return nil
+}
+
+// cryptoAPIDehydratedMagicName/Value tag certs that were reconstructed by the
+// certdehydrate package from a compact "tls" record, as opposed to certs
+// added via a full DER blob.  This lets cleanCertsCryptoAPI distinguish them
+// from user-added Namecoin certs and apply a shorter expiry, since they
+// encode per-lookup browsing history.
+const cryptoAPIDehydratedMagicName = "NamecoinDehydrated"
+const cryptoAPIDehydratedMagicValue = 2
+
+// cryptoAPIRevokedMagicName/Value tag certs injected by RevokeCert into the
+// Disallowed logical store, so that cleanCertsCryptoAPI (which only
+// recognizes cryptoAPIMagicName and cryptoAPIDehydratedMagicName) never
+// treats them as expired and garbage-collects them.
+const cryptoAPIRevokedMagicName = "NamecoinRevoked"
+const cryptoAPIRevokedMagicValue = 1
+
+// cryptoAPIDisallowedLogicalStoreName is the CryptoAPI logical store that
+// browsers and schannel treat as a hard denylist, regardless of what's
+// configured via -capi.logical-store.
+const cryptoAPIDisallowedLogicalStoreName = "Disallowed"
+
+// cryptoAPIGroupPolicyPhysicalStoreName is the -capi.physical-store value
+// whose registry key group policy replicates to domain-joined machines
+// asynchronously.  Because replication can snapshot a cert's registry key
+// mid-write, writes to this store go through injectCertCryptoAPIStaged
+// instead of being written directly, so replication never observes a
+// half-written blob.
+const cryptoAPIGroupPolicyPhysicalStoreName = "group-policy"
+
+// cryptoAPIStagingKeySuffix marks a cert's sibling staging key, used by
+// injectCertCryptoAPIStaged's two-phase commit and recognized by
+// cleanCertsCryptoAPI so it can sweep one left behind by a crash between
+// writing it and promoting it.
+const cryptoAPIStagingKeySuffix = ".staging"
+
+// cryptoAPIStagingMutexPrefix namespaces the named mutex that serializes a
+// staging key's promotion, so it can't collide with an unrelated named
+// kernel object elsewhere on the system.
+const cryptoAPIStagingMutexPrefix = `Namecoin-CertInject-Staging-`
+
 var (
 	// cryptoAPIStores consists of every implemented store.
 	// when adding a new one, the `%s` variable is optional.
@@ -51,7 +123,15 @@ func (s Store) String() string {
 
 // Key generates the registry key for use in opening the store.
 func (s Store) Key() string {
-	return fmt.Sprintf(`%s\`+s.Logical, s.Physical, cryptoAPIFlagLogicalStoreName.Value())
+	return s.KeyFor(cryptoAPIFlagLogicalStoreName.Value())
+}
+
+// KeyFor generates the registry key for use in opening the store, using the
+// given CryptoAPI logical store name instead of -capi.logical-store.  This
+// lets callers target a specific logical store (e.g. Disallowed, for
+// RevokeCert) regardless of how -capi.logical-store is configured.
+func (s Store) KeyFor(logicalStoreName string) string {
+	return fmt.Sprintf(`%s\`+s.Logical, s.Physical, logicalStoreName)
 }
 
 // cryptoAPINameToStore checks that the choice is valid before returning a complete Store request
@@ -63,14 +143,51 @@ func cryptoAPINameToStore(name string) (Store, error) {
 	return store, nil
 }
 
-func injectCertCryptoAPI(derBytes []byte) {
-	store, err := cryptoAPINameToStore(cryptoAPIFlagPhysicalStoreName.Value())
+// wrapRegistryErr wraps a registry operation failure with the given sentinel
+// error, except that access-denied failures are always reported as
+// ErrPermissionDenied regardless of which step they occurred in, since that's
+// the detail callers actually care about.
+func wrapRegistryErr(sentinel error, err error) error {
+	if errors.Is(err, windows.ERROR_ACCESS_DENIED) {
+		return fmt.Errorf("%w: %s", ErrPermissionDenied, err)
+	}
+
+	return fmt.Errorf("%w: %s", sentinel, err)
+}
+
+func injectCertCryptoAPI(derBytes []byte) error {
+	return injectCertCryptoAPIWithMagic(derBytes, cryptoAPIMagicName, cryptoAPIMagicValue)
+}
+
+// injectCertCryptoAPIDehydrated injects a cert that was reconstructed by the
+// certdehydrate package, tagging it with a distinct magic value so that
+// cleanCertsCryptoAPI can apply a shorter expiry to it than to certs injected
+// via injectCertCryptoAPI.
+func injectCertCryptoAPIDehydrated(derBytes []byte) error {
+	return injectCertCryptoAPIWithMagic(derBytes, cryptoAPIDehydratedMagicName, cryptoAPIDehydratedMagicValue)
+}
+
+// injectCertCryptoAPIRevoked injects a cert into the Disallowed logical
+// store, tagged so that cleanCertsCryptoAPI never expires it.  This is what
+// backs the exported RevokeCert API.
+func injectCertCryptoAPIRevoked(derBytes []byte) error {
+	return injectCertCryptoAPIToLogicalStore(derBytes, cryptoAPIRevokedMagicName,
+		cryptoAPIRevokedMagicValue, cryptoAPIDisallowedLogicalStoreName)
+}
+
+func injectCertCryptoAPIWithMagic(derBytes []byte, magicName string, magicValue uint32) error {
+	return injectCertCryptoAPIToLogicalStore(derBytes, magicName, magicValue, cryptoAPIFlagLogicalStoreName.Value())
+}
+
+func injectCertCryptoAPIToLogicalStore(derBytes []byte, magicName string, magicValue uint32, logicalStoreName string) error {
+	physicalStoreName := cryptoAPIFlagPhysicalStoreName.Value()
+
+	store, err := cryptoAPINameToStore(physicalStoreName)
 	if err != nil {
-		log.Errorf("error: %s", err.Error())
-		return
+		return fmt.Errorf("error: %w", err)
 	}
 	registryBase := store.Base
-	storeKey := store.Key()
+	storeKey := store.KeyFor(logicalStoreName)
 
 	// Format documentation of Microsoft's "Certificate Registry Blob":
 
@@ -109,25 +226,38 @@ func injectCertCryptoAPI(derBytes []byte) {
 	// cert length
 	// cert
 
-	// But, guess what?  All you need is the "20" record.
-	// Windows will happily regenerate all the others for you, whenever you actually try to use the certificate.
-	// How cool is that?
+	// All you strictly need is the "20" record; Windows will happily
+	// regenerate all the others for you, whenever you actually try to use
+	// the certificate.  However, some enterprise scanners and group policy
+	// propagation read the blob directly out of the registry without ever
+	// invoking CryptGetCertificate, so -capi.full-blob populates the whole
+	// set up front instead of relying on that lazy regeneration.
+	var blob certblob.Blob
 
-	// Construct the Blob
-	blob := certblob.Blob{0x20: derBytes}
+	if cryptoAPIFlagFullBlob.Value() {
+		cert, err := x509.ParseCertificate(derBytes)
+		if err != nil {
+			return fmt.Errorf("couldn't parse certificate for full blob: %w", err)
+		}
+
+		blob, err = certblob.BuildFullBlob(cert)
+		if err != nil {
+			return fmt.Errorf("couldn't build full cert blob: %w", err)
+		}
+	} else {
+		blob = certblob.Blob{certblob.CertContentCertPropID: derBytes}
+	}
 
 	// Marshal the Blob
 	blobBytes, err := blob.Marshal()
 	if err != nil {
-		log.Errorf("Couldn't marshal cert blob: %s", err)
-		return
+		return fmt.Errorf("couldn't marshal cert blob: %w", err)
 	}
 
 	// Open up the cert store.
 	certStoreKey, err := registry.OpenKey(registryBase, storeKey, registry.ALL_ACCESS)
 	if err != nil {
-		log.Errorf("Couldn't open cert store: %s", err)
-		return
+		return wrapRegistryErr(ErrStoreOpenFailed, fmt.Errorf("couldn't open cert store: %w", err))
 	}
 	defer certStoreKey.Close()
 
@@ -142,14 +272,96 @@ func injectCertCryptoAPI(derBytes []byte) {
 	// Windows CryptoAPI uses uppercase hex strings
 	fingerprintHexUpper := strings.ToUpper(fingerprintHex)
 
+	// Group policy replicates its registry key to domain-joined machines
+	// asynchronously, so a direct write here risks replication catching the
+	// cert key mid-write.  Route it through a staged commit instead.
+	var openedExisting bool
+
+	if physicalStoreName == cryptoAPIGroupPolicyPhysicalStoreName {
+		openedExisting, err = injectCertCryptoAPIStaged(certStoreKey, fingerprintHexUpper, magicName, magicValue, blobBytes)
+	} else {
+		openedExisting, err = writeCertCryptoAPIKey(certStoreKey, fingerprintHexUpper, magicName, magicValue, blobBytes)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	auditCryptoAPIAddOrRefresh(openedExisting, physicalStoreName, logicalStoreName, fingerprintHexUpper, len(derBytes))
+
+	return nil
+}
+
+// injectCertCryptoAPIStaged performs a two-phase commit of a cert's key
+// under certStoreKey: the complete magic value and blob are written to a
+// sibling "<fingerprint>.staging" key first, then promoted into the real
+// "<fingerprint>" key and the staging key is removed, with the promotion
+// step serialized by a named mutex so only one injectCertCryptoAPIStaged
+// call at a time promotes a given fingerprint.  cleanCertsCryptoAPI does not
+// take the mutex.
+func injectCertCryptoAPIStaged(certStoreKey registry.Key, fingerprintHexUpper, magicName string, magicValue uint32, blobBytes []byte) (openedExisting bool, err error) {
+	stagingKeyName := fingerprintHexUpper + cryptoAPIStagingKeySuffix
+
+	if _, err := writeCertCryptoAPIKey(certStoreKey, stagingKeyName, magicName, magicValue, blobBytes); err != nil {
+		return false, fmt.Errorf("couldn't write staging key: %w", err)
+	}
+
+	release, err := acquireStagingMutex(fingerprintHexUpper)
+	if err != nil {
+		return false, fmt.Errorf("couldn't lock staging key for promotion: %w", err)
+	}
+	defer release()
+
+	openedExisting, err = writeCertCryptoAPIKey(certStoreKey, fingerprintHexUpper, magicName, magicValue, blobBytes)
+	if err != nil {
+		return false, fmt.Errorf("couldn't promote staging key: %w", err)
+	}
+
+	if err := registry.DeleteKey(certStoreKey, stagingKeyName); err != nil {
+		return false, wrapRegistryErr(ErrBlobWriteFailed, fmt.Errorf("couldn't delete staging key after promotion: %w", err))
+	}
+
+	return openedExisting, nil
+}
+
+// acquireStagingMutex acquires a system-wide named mutex scoped to the
+// given cert fingerprint, so that only one injectCertCryptoAPIStaged call
+// at a time can be promoting that fingerprint's staging key.  The returned
+// func releases and closes it.
+func acquireStagingMutex(fingerprintHexUpper string) (func(), error) {
+	name, err := windows.UTF16PtrFromString(cryptoAPIStagingMutexPrefix + fingerprintHexUpper)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't encode mutex name: %w", err)
+	}
+
+	handle, err := windows.CreateMutex(nil, false, name)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create mutex: %w", err)
+	}
+
+	if _, err := windows.WaitForSingleObject(handle, windows.INFINITE); err != nil {
+		_ = windows.CloseHandle(handle)
+		return nil, fmt.Errorf("couldn't acquire mutex: %w", err)
+	}
+
+	return func() {
+		_ = windows.ReleaseMutex(handle)
+		_ = windows.CloseHandle(handle)
+	}, nil
+}
+
+// writeCertCryptoAPIKey creates (or overwrites) the cert registry key named
+// keyName under certStoreKey, setting its magic DWORD and Blob value, and
+// flushes it to make sure a concurrent reader (e.g. a promotion step
+// immediately following a staging write) observes the complete key.
+func writeCertCryptoAPIKey(certStoreKey registry.Key, keyName, magicName string, magicValue uint32, blobBytes []byte) (openedExisting bool, err error) {
 	// Create the registry key in which we will store the cert.
 	// The 2nd result of CreateKey is openedExisting, which tells us if the cert already existed.
-	// This doesn't matter to us.  If true, the "last modified" metadata won't update,
-	// but we delete and recreate the magic value inside it as a workaround.
-	certKey, _, err := registry.CreateKey(certStoreKey, fingerprintHexUpper, registry.ALL_ACCESS)
+	// This doesn't matter to the blob/magic writes below, but callers use it
+	// to tell an add from a refresh for audit purposes.
+	certKey, openedExisting, err := registry.CreateKey(certStoreKey, keyName, registry.ALL_ACCESS)
 	if err != nil {
-		log.Errorf("Couldn't create registry key for certificate: %s", err)
-		return
+		return false, wrapRegistryErr(ErrStoreOpenFailed, fmt.Errorf("couldn't create registry key for certificate: %w", err))
 	}
 	defer certKey.Close()
 
@@ -159,81 +371,188 @@ func injectCertCryptoAPI(derBytes []byte) {
 	// so that we make sure that the "last modified" metadata gets updated.
 	// If an error occurs during deletion, we ignore it,
 	// since it probably just means it wasn't there already.
-	_ = certKey.DeleteValue(cryptoAPIMagicName)
+	_ = certKey.DeleteValue(magicName)
 
-	err = certKey.SetDWordValue(cryptoAPIMagicName, cryptoAPIMagicValue)
+	err = certKey.SetDWordValue(magicName, magicValue)
 	if err != nil {
-		log.Errorf("Couldn't set magic registry value for certificate: %s", err)
-		return
+		return false, wrapRegistryErr(ErrBlobWriteFailed, fmt.Errorf("couldn't set magic registry value for certificate: %w", err))
 	}
 
 	// Create the registry value which holds the certificate.
 	err = certKey.SetBinaryValue("Blob", blobBytes)
 	if err != nil {
-		log.Errorf("Couldn't set blob registry value for certificate: %s", err)
-		return
+		return false, wrapRegistryErr(ErrBlobWriteFailed, fmt.Errorf("couldn't set blob registry value for certificate: %w", err))
+	}
+
+	if err := regFlushKey(certKey); err != nil {
+		return false, wrapRegistryErr(ErrBlobWriteFailed, fmt.Errorf("couldn't flush registry key for certificate: %w", err))
+	}
+
+	return openedExisting, nil
+}
+
+// cleanCertsCryptoAPI sweeps every logical store that injectCertCryptoAPI*
+// can write to: the one configured via -capi.logical-store, and the
+// Disallowed store that RevokeCert always targets regardless of that
+// setting.  Without sweeping Disallowed too, a staging key abandoned there
+// by a crashed RevokeCert call (see injectCertCryptoAPIStaged) would never
+// be visited, since CleanCerts would otherwise only ever open the
+// configured store.
+func cleanCertsCryptoAPI() error {
+	logicalStoreNames := []string{cryptoAPIFlagLogicalStoreName.Value()}
+
+	if cryptoAPIDisallowedLogicalStoreName != logicalStoreNames[0] {
+		logicalStoreNames = append(logicalStoreNames, cryptoAPIDisallowedLogicalStoreName)
+	}
+
+	var errs []error
+
+	for _, logicalStoreName := range logicalStoreNames {
+		if err := cleanCertsCryptoAPILogicalStore(logicalStoreName); err != nil {
+			errs = append(errs, err)
+		}
 	}
+
+	return errors.Join(errs...)
 }
 
-func cleanCertsCryptoAPI() {
-	store, err := cryptoAPINameToStore(cryptoAPIFlagPhysicalStoreName.Value())
+// cleanCertsCryptoAPILogicalStore sweeps a single logical store for expired
+// certs and abandoned staging keys.
+func cleanCertsCryptoAPILogicalStore(logicalStoreName string) error {
+	physicalStoreName := cryptoAPIFlagPhysicalStoreName.Value()
+
+	store, err := cryptoAPINameToStore(physicalStoreName)
 	if err != nil {
-		log.Errorf("error: %s", err.Error())
-		return
+		return fmt.Errorf("error: %w", err)
 	}
 	registryBase := store.Base
-	storeKey := store.Key()
+	storeKey := store.KeyFor(logicalStoreName)
 
 	// Open up the cert store.
 	certStoreKey, err := registry.OpenKey(registryBase, storeKey, registry.ALL_ACCESS)
 	if err != nil {
-		log.Errorf("Couldn't open cert store: %s", err)
-		return
+		return wrapRegistryErr(ErrStoreOpenFailed, fmt.Errorf("couldn't open cert store: %w", err))
 	}
 	defer certStoreKey.Close()
 
 	// get all subkey names in the cert store
 	subKeys, err := certStoreKey.ReadSubKeyNames(0)
 	if err != nil {
-		log.Errorf("Couldn't list certs in cert store: %s", err)
-		return
+		return wrapRegistryErr(ErrStoreOpenFailed, fmt.Errorf("couldn't list certs in cert store: %w", err))
 	}
 
+	var errs []error
+
 	// for all certs in the cert store
 	for _, subKeyName := range subKeys {
+		// A staging key left behind by an injectCertCryptoAPIStaged call
+		// that died before promoting it is swept on its own schedule,
+		// since it carries the same magic value as the cert it stages, and
+		// checkCertExpiredCryptoAPI never expires a RevokeCert one.
+		if strings.HasSuffix(subKeyName, cryptoAPIStagingKeySuffix) {
+			abandoned, err := checkStagingKeyAbandonedCryptoAPI(certStoreKey, subKeyName)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("couldn't check if staging cert key is abandoned: %w", err))
+				continue
+			}
+
+			if abandoned {
+				if err := registry.DeleteKey(certStoreKey, subKeyName); err != nil {
+					errs = append(errs, wrapRegistryErr(ErrBlobWriteFailed, fmt.Errorf("couldn't delete abandoned staging cert key: %w", err)))
+				}
+			}
+
+			continue
+		}
+
 		// Check if the cert is expired
 		expired, err := checkCertExpiredCryptoAPI(certStoreKey, subKeyName)
 		if err != nil {
-			log.Errorf("Couldn't check if cert is expired: %s", err)
-			return
+			errs = append(errs, fmt.Errorf("couldn't check if cert is expired: %w", err))
+			continue
 		}
 
 		// delete the cert if it's expired
 		if expired {
+			derLen := blobLenCryptoAPI(certStoreKey, subKeyName)
+
 			if err := registry.DeleteKey(certStoreKey, subKeyName); err != nil {
-				log.Errorf("Coudn't delete expired cert: %s", err)
+				errs = append(errs, wrapRegistryErr(ErrBlobWriteFailed, fmt.Errorf("couldn't delete expired cert: %w", err)))
+				continue
 			}
+
+			auditCryptoAPI(cryptoAPIAuditEventDeleted, "deleted", physicalStoreName, logicalStoreName, subKeyName, derLen)
 		}
 	}
+
+	return errors.Join(errs...)
 }
 
-func checkCertExpiredCryptoAPI(certStoreKey registry.Key, subKeyName string) (bool, error) {
-	// Open the cert
+// blobLenCryptoAPI returns the DER length of the certificate stored in
+// subKeyName's "Blob" registry value, for audit log purposes, or 0 if it
+// can't be read.
+func blobLenCryptoAPI(certStoreKey registry.Key, subKeyName string) int {
 	certKey, err := registry.OpenKey(certStoreKey, subKeyName, registry.ALL_ACCESS)
 	if err != nil {
-		return false, fmt.Errorf("Couldn't open cert registry key: %s", err)
+		return 0
 	}
 	defer certKey.Close()
 
-	// Check for magic value
-	isNamecoin, _, err := certKey.GetIntegerValue(cryptoAPIMagicName)
+	blobBytes, _, err := certKey.GetBinaryValue("Blob")
 	if err != nil {
-		// Magic value wasn't found.  Therefore don't consider it expired.
-		return false, nil
+		return 0
+	}
+
+	blob, err := certblob.ParseBlob(blobBytes)
+	if err != nil {
+		return 0
+	}
+
+	return len(blob[certblob.CertContentCertPropID])
+}
+
+// checkStagingKeyAbandonedCryptoAPI reports whether a "<fingerprint>.staging"
+// key is old enough that its injectCertCryptoAPIStaged call must have died
+// before promoting it, e.g. because the process crashed between writing the
+// staging key and acquiring the promotion mutex.
+func checkStagingKeyAbandonedCryptoAPI(certStoreKey registry.Key, subKeyName string) (bool, error) {
+	stagingKey, err := registry.OpenKey(certStoreKey, subKeyName, registry.ALL_ACCESS)
+	if err != nil {
+		return false, fmt.Errorf("Couldn't open staging cert registry key: %s", err)
+	}
+	defer stagingKey.Close()
+
+	stagingKeyInfo, err := stagingKey.Stat()
+	if err != nil {
+		return false, fmt.Errorf("Couldn't read metadata for staging cert registry key: %s", err)
 	}
 
-	if isNamecoin != cryptoAPIMagicValue {
-		// Magic value was found but it wasn't the one we recognize.  Therefore don't consider it expired.
+	abandoned := math.Abs(time.Since(stagingKeyInfo.ModTime()).Seconds()) > float64(certExpirePeriod.Value())
+
+	return abandoned, nil
+}
+
+func checkCertExpiredCryptoAPI(certStoreKey registry.Key, subKeyName string) (bool, error) {
+	// Open the cert
+	certKey, err := registry.OpenKey(certStoreKey, subKeyName, registry.ALL_ACCESS)
+	if err != nil {
+		return false, fmt.Errorf("Couldn't open cert registry key: %s", err)
+	}
+	defer certKey.Close()
+
+	// Check for a magic value, and pick the expiry period that applies to it.
+	// Dehydrated certs get a much shorter expiry, since they encode
+	// per-lookup browsing history.
+	var expirePeriod int
+
+	switch {
+	case isMagicValue(certKey, cryptoAPIMagicName, cryptoAPIMagicValue):
+		expirePeriod = certExpirePeriod.Value()
+	case isMagicValue(certKey, cryptoAPIDehydratedMagicName, cryptoAPIDehydratedMagicValue):
+		expirePeriod = cryptoAPIDehydratedExpirePeriod.Value()
+	default:
+		// No magic value we recognize was found.  Therefore don't consider
+		// it expired.
 		return false, nil
 	}
 
@@ -248,7 +567,13 @@ func checkCertExpiredCryptoAPI(certStoreKey registry.Key, subKeyName string) (bo
 
 	// If the cert's last modified timestamp differs too much from the
 	// current time in either direction, consider it expired
-	expired := math.Abs(time.Since(certKeyModTime).Seconds()) > float64(certExpirePeriod.Value())
+	expired := math.Abs(time.Since(certKeyModTime).Seconds()) > float64(expirePeriod)
 
 	return expired, nil
 }
+
+// isMagicValue reports whether certKey has the given magic DWORD value set.
+func isMagicValue(certKey registry.Key, magicName string, magicValue uint32) bool {
+	value, _, err := certKey.GetIntegerValue(magicName)
+	return err == nil && value == uint64(magicValue)
+}
@@ -0,0 +1,20 @@
+package certinject
+
+import (
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+)
+
+// Injects a certificate by writing to a file.  Used by trust stores that are
+// driven via an on-disk certificate rather than a direct API, such as NSS.
+func injectCertFile(derBytes []byte, fileName string) error {
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
+
+	err := ioutil.WriteFile(fileName, pemBytes, 0644)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrBlobWriteFailed, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,279 @@
+package certinject
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/hlandau/easyconfig.v1/cflag"
+)
+
+// This file implements a cross-platform NSS trust store backend.  It drives
+// the same "certutil" tool used by Firefox, Chromium/Chrome, and Thunderbird
+// to manage their sql:-format NSS cert9.db databases.  Unlike CryptoAPI, NSS
+// is available on every OS that certinject supports, so this backend has no
+// _windows.go / _notwindows.go split of its own.
+
+var (
+	nssFlagGroup         = cflag.NewGroup(flagGroup, "nss")
+	nssFlagPhysicalStore = cflag.String(nssFlagGroup, "physical-store", "firefox",
+		"Scope of NSS certificate store. Valid choices: firefox, chromium, thunderbird, system")
+	nssFlagProfileDir = cflag.String(nssFlagGroup, "profile-dir", "",
+		"Path to the NSS profile directory (the one containing cert9.db) to "+
+			"inject into.  Overrides the default profile directory for the "+
+			"selected -nss.physical-store.  Required for physical stores whose "+
+			"profile directory is not at a fixed path, e.g. Firefox.")
+	nssFlagCertDir = cflag.String(nssFlagGroup, "cert-dir", "",
+		"Directory to store certificate files in, so that injected certs can "+
+			"be tracked for expiry.  Only use a directory that only ncdns can "+
+			"write to.  (Required if nss is enabled.)")
+)
+
+// nssNicknamePrefix tags every cert we add to an NSS database, so that
+// cleanCertsNSS can tell our certs apart from ones the user added themselves.
+// This is NSS's equivalent of the `Namecoin` DWORD magic value used by the
+// CryptoAPI backend.
+const nssNicknamePrefix = "Namecoin-"
+
+// nssPKCS11GeneralErrorMaxRetries bounds how many times injectCertNSS and
+// deleteCertNSS retry a certutil invocation that failed with
+// SEC_ERROR_PKCS11_GENERAL_ERROR, which is usually transient NSS database
+// lock contention that clears up almost immediately.  Without a bound, a
+// cert that keeps hitting the same error would retry forever.
+const nssPKCS11GeneralErrorMaxRetries = 10
+
+// nssStores lists the default profile directory for every NSS-backed
+// application we know how to target, relative to the user's home directory
+// unless it is an absolute path.
+// A store maps to "" if it has no fixed profile directory, meaning
+// -nss.profile-dir must be set explicitly instead.
+var nssStores = map[string]string{
+	"firefox":     "", // Real Firefox profile dirs have a randomly generated suffix, e.g. ~/.mozilla/firefox/<profile>.
+	"chromium":    ".pki/nssdb",
+	"thunderbird": "", // Real Thunderbird profile dirs have a randomly generated suffix, e.g. ~/.thunderbird/<profile>.
+	"system":      "/etc/pki/nssdb",
+}
+
+// nssNameToProfileDir resolves the configured -nss.physical-store to a
+// profile directory, honoring an explicit -nss.profile-dir override.  It
+// returns an error instead of a placeholder if name has no fixed profile
+// directory and -nss.profile-dir wasn't set, so callers don't go on to hand
+// certutil a documentation string like ".mozilla/firefox/<profile>" as a
+// literal path.
+func nssNameToProfileDir(name string) (string, error) {
+	if dir := nssFlagProfileDir.Value(); dir != "" {
+		return dir, nil
+	}
+
+	profileDir, ok := nssStores[name]
+	if !ok {
+		return "", fmt.Errorf("invalid choice for physical store, consider: firefox, chromium, thunderbird, system")
+	}
+
+	if profileDir == "" {
+		return "", fmt.Errorf("-nss.profile-dir must be set explicitly when -nss.physical-store=%s", name)
+	}
+
+	if !filepath.IsAbs(profileDir) {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("couldn't find home directory for -nss.physical-store=%s: %w", name, err)
+		}
+
+		profileDir = filepath.Join(homeDir, profileDir)
+	}
+
+	return profileDir, nil
+}
+
+func nicknameFromFingerprintHexNSS(fingerprintHex string) string {
+	return nssNicknamePrefix + fingerprintHex
+}
+
+func injectCertNSS(derBytes []byte) error {
+	if nssFlagCertDir.Value() == "" {
+		return fmt.Errorf("%w: empty nss.cert-dir configuration", ErrStoreOpenFailed)
+	}
+
+	profileDir, err := nssNameToProfileDir(nssFlagPhysicalStore.Value())
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrStoreOpenFailed, err)
+	}
+
+	fingerprint := sha256.Sum256(derBytes)
+	fingerprintHex := hex.EncodeToString(fingerprint[:])
+
+	path := nssFlagCertDir.Value() + "/" + fingerprintHex + ".pem"
+
+	if err := injectCertFile(derBytes, path); err != nil {
+		return err
+	}
+
+	nickname := nicknameFromFingerprintHexNSS(fingerprintHex)
+
+	// The "C,," trust flags trust the cert as a CA for TLS only, not for
+	// email or object signing.
+	for attempt := 0; ; attempt++ {
+		cmd := exec.Command("certutil", "-A", "-d", "sql:"+profileDir,
+			"-n", nickname, "-t", "C,,", "-a", "-i", path)
+
+		stdoutStderr, err := cmd.CombinedOutput()
+		if err == nil {
+			return nil
+		}
+
+		if attempt >= nssPKCS11GeneralErrorMaxRetries || !strings.Contains(string(stdoutStderr), "SEC_ERROR_PKCS11_GENERAL_ERROR") {
+			return fmt.Errorf("%w: error injecting cert to NSS database: %s\n%s", ErrBlobWriteFailed, err, stdoutStderr)
+		}
+
+		log.Warn("Temporary SEC_ERROR_PKCS11_GENERAL_ERROR injecting certificate to NSS database; retrying in 1ms...")
+		time.Sleep(1 * time.Millisecond)
+	}
+}
+
+func cleanCertsNSS() error {
+	if nssFlagCertDir.Value() == "" {
+		return fmt.Errorf("%w: empty nss.cert-dir configuration", ErrStoreOpenFailed)
+	}
+
+	profileDir, err := nssNameToProfileDir(nssFlagPhysicalStore.Value())
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrStoreOpenFailed, err)
+	}
+
+	// List the trust entries that already exist, so we only ever touch ones
+	// tagged with our nickname prefix.
+	trustedNicknames, err := nssTrustedNicknames(profileDir)
+	if err != nil {
+		return fmt.Errorf("%w: error listing NSS trust entries: %s", ErrStoreOpenFailed, err)
+	}
+
+	trustedNicknameSet := map[string]bool{}
+	for _, nickname := range trustedNicknames {
+		trustedNicknameSet[nickname] = true
+	}
+
+	certFiles, err := ioutil.ReadDir(nssFlagCertDir.Value() + "/")
+	if err != nil {
+		return fmt.Errorf("%w: error enumerating files in cert directory: %s", ErrStoreOpenFailed, err)
+	}
+
+	var errs []error
+
+	// for all Namecoin certs in the folder
+	for _, f := range certFiles {
+		filename := f.Name()
+		fingerprintHex := strings.Replace(filename, ".pem", "", -1)
+		nickname := nicknameFromFingerprintHexNSS(fingerprintHex)
+
+		if !trustedNicknameSet[nickname] {
+			// The cert was already removed from NSS (e.g. by the user), so
+			// there's nothing to untrust; just clean up the sidecar file.
+			if err := os.Remove(nssFlagCertDir.Value() + "/" + filename); err != nil {
+				errs = append(errs, fmt.Errorf("%w: error deleting orphaned NSS cert sidecar file: %s", ErrBlobWriteFailed, err))
+			}
+			continue
+		}
+
+		// Check if the cert is expired
+		expired, err := checkCertExpiredNSS(f)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error checking if NSS cert is expired: %w", err))
+			continue
+		}
+
+		if !expired {
+			continue
+		}
+
+		// Delete the cert from NSS
+		if err := deleteCertNSS(profileDir, nickname); err != nil {
+			errs = append(errs, err)
+		}
+
+		// Also delete the cert from the filesystem
+		if err := os.Remove(nssFlagCertDir.Value() + "/" + filename); err != nil {
+			errs = append(errs, fmt.Errorf("%w: error deleting NSS cert from filesystem: %s", ErrBlobWriteFailed, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// deleteCertNSS removes nickname's trust entry from the NSS database at
+// profileDir.  SEC_ERROR_UNRECOGNIZED_OID (the cert was already not present)
+// is treated as success, and a transient SEC_ERROR_PKCS11_GENERAL_ERROR is
+// retried up to nssPKCS11GeneralErrorMaxRetries times before being reported.
+func deleteCertNSS(profileDir, nickname string) error {
+	for attempt := 0; ; attempt++ {
+		cmd := exec.Command("certutil", "-d", "sql:"+profileDir, "-D", "-n", nickname)
+
+		stdoutStderr, err := cmd.CombinedOutput()
+
+		switch {
+		case err == nil:
+			return nil
+		case strings.Contains(string(stdoutStderr), "SEC_ERROR_UNRECOGNIZED_OID"):
+			log.Warn("Tried to delete certificate from NSS database, " +
+				"but the certificate was already not present in NSS database")
+			return nil
+		case attempt < nssPKCS11GeneralErrorMaxRetries && strings.Contains(string(stdoutStderr), "SEC_ERROR_PKCS11_GENERAL_ERROR"):
+			log.Warn("Temporary SEC_ERROR_PKCS11_GENERAL_ERROR deleting certificate from NSS database; retrying in 1ms...")
+			time.Sleep(1 * time.Millisecond)
+		default:
+			return fmt.Errorf("%w: error deleting cert from NSS database: %s\n%s", ErrBlobWriteFailed, err, stdoutStderr)
+		}
+	}
+}
+
+// nssTrustedNicknames lists the nicknames of every trust entry in the given
+// profile's NSS database that is tagged with our nickname prefix.
+func nssTrustedNicknames(profileDir string) ([]string, error) {
+	cmd := exec.Command("certutil", "-L", "-d", "sql:"+profileDir)
+
+	stdout, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list NSS trust entries: %w", err)
+	}
+
+	nicknames := []string{}
+
+	for _, line := range strings.Split(string(stdout), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if !strings.HasPrefix(fields[0], nssNicknamePrefix) {
+			continue
+		}
+
+		nicknames = append(nicknames, fields[0])
+	}
+
+	return nicknames, nil
+}
+
+// checkCertExpiredNSS determines whether an injected cert is due for removal.
+// NSS has no equivalent of CryptoAPI's per-value "last modified" metadata, so
+// we store the injection timestamp in the sidecar PEM file's mtime instead.
+func checkCertExpiredNSS(certFile os.FileInfo) (bool, error) {
+	certFileModTime := certFile.ModTime()
+
+	age := time.Since(certFileModTime)
+	ageSeconds := age.Seconds()
+
+	expired := math.Abs(ageSeconds) > float64(certExpirePeriod.Value())
+
+	log.Debugf("Age of certificate: %s = %f seconds; expired = %t", age, ageSeconds, expired)
+
+	return expired, nil
+}